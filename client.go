@@ -0,0 +1,200 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ErrClientClosed is returned by a Call or Go made on a Client after Close
+// has been called. Calls already in flight when Close runs fail with their
+// context's error instead.
+var ErrClientClosed = errors.New("rpc: client is closed")
+
+// ClientCodec marshals outgoing call arguments and unmarshals server
+// responses for a Client. It is the client-side counterpart of Codec: a
+// codec that ships a Codec for the server (e.g. JSON-RPC 2.0) should ship a
+// ClientCodec too.
+type ClientCodec interface {
+	// EncodeClientRequest returns the HTTP request body for calling method
+	// with the given args.
+	EncodeClientRequest(method string, args interface{}) ([]byte, error)
+	// DecodeClientResponse unmarshals an HTTP response body into reply. It
+	// returns any RPC-level error reported by the server.
+	DecodeClientResponse(body []byte, reply interface{}) error
+}
+
+// Call represents an active or completed RPC call, modeled on net/rpc.Call.
+type Call struct {
+	Method string
+	Args   interface{}
+	Reply  interface{}
+	Error  error
+	Done   chan *Call
+}
+
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		// Done is buffered for the single send GoContext makes; if the
+		// caller isn't reading, don't block the goroutine doing the call.
+	}
+}
+
+// Client is an RPC client that calls methods on a server built with
+// NewServer, using a ClientCodec symmetric to the server's Codec.
+//
+// A Client is safe for concurrent use by multiple goroutines.
+type Client struct {
+	mutex   sync.Mutex
+	seq     uint64
+	pending map[uint64]context.CancelFunc
+	closed  bool
+
+	codec       ClientCodec
+	httpClient  *http.Client
+	serverURL   string
+	contentType string
+}
+
+// NewClient returns a new Client that POSTs requests to serverURL, encoding
+// and decoding them with codec. It uses http.DefaultClient and a
+// "Content-Type" of "application/json" until overridden with
+// SetHTTPClient/SetContentType.
+func NewClient(serverURL string, codec ClientCodec) *Client {
+	return &Client{
+		codec:       codec,
+		serverURL:   serverURL,
+		httpClient:  http.DefaultClient,
+		contentType: "application/json",
+		pending:     make(map[uint64]context.CancelFunc),
+	}
+}
+
+// SetHTTPClient overrides the http.Client used to make requests, e.g. to
+// inject a custom Transport for connection pooling or TLS configuration.
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// SetContentType overrides the "Content-Type" header sent with every
+// request.
+func (c *Client) SetContentType(contentType string) {
+	c.contentType = contentType
+}
+
+// Call invokes the named method, waits for it to complete, and returns its
+// error status.
+func (c *Client) Call(method string, args, reply interface{}) error {
+	return c.CallContext(context.Background(), method, args, reply)
+}
+
+// CallContext is like Call but cancels the in-flight HTTP request as soon
+// as ctx is done.
+func (c *Client) CallContext(ctx context.Context, method string, args, reply interface{}) error {
+	call := <-c.GoContext(ctx, method, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
+// Go invokes the named method asynchronously. It returns the Call structure
+// representing the invocation; call.Done is sent the same Call once the
+// call completes. If done is nil, a new buffered channel is allocated; if
+// non-nil, it must be buffered or Go will panic. If done is buffered but
+// full when the call completes, the send is dropped.
+func (c *Client) Go(method string, args, reply interface{}, done chan *Call) *Call {
+	return c.GoContext(context.Background(), method, args, reply, done)
+}
+
+// GoContext is like Go but cancels the in-flight HTTP request as soon as
+// ctx is done.
+func (c *Client) GoContext(ctx context.Context, method string, args, reply interface{}, done chan *Call) *Call {
+	call := &Call{Method: method, Args: args, Reply: reply}
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+	call.Done = done
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		call.Error = ErrClientClosed
+		call.done()
+		return call
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = cancel
+	c.mutex.Unlock()
+
+	go c.send(ctx, seq, call)
+	return call
+}
+
+func (c *Client) send(ctx context.Context, seq uint64, call *Call) {
+	defer func() {
+		c.mutex.Lock()
+		cancel, ok := c.pending[seq]
+		delete(c.pending, seq)
+		c.mutex.Unlock()
+		if ok {
+			cancel()
+		}
+		call.done()
+	}()
+
+	body, err := c.codec.EncodeClientRequest(call.Method, call.Args)
+	if err != nil {
+		call.Error = err
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serverURL, bytes.NewReader(body))
+	if err != nil {
+		call.Error = err
+		return
+	}
+	req.Header.Set("Content-Type", c.contentType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		call.Error = err
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		call.Error = err
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		call.Error = fmt.Errorf("rpc: server returned status %d: %s", resp.StatusCode, string(respBody))
+		return
+	}
+	call.Error = c.codec.DecodeClientResponse(respBody, call.Reply)
+}
+
+// Close marks the client closed and cancels every in-flight call: each
+// fails with its context's error (rather than running to completion) as
+// soon as its HTTP round trip notices the cancellation. New calls, and
+// calls started concurrently with Close, fail immediately with
+// ErrClientClosed.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	pending := c.pending
+	c.pending = make(map[uint64]context.CancelFunc)
+	c.mutex.Unlock()
+
+	for _, cancel := range pending {
+		cancel()
+	}
+	return nil
+}
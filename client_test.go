@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClientCodec is a minimal ClientCodec for tests: it sends args as the
+// raw JSON request body and decodes the response body directly into reply.
+type fakeClientCodec struct{}
+
+func (fakeClientCodec) EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	return json.Marshal(args)
+}
+
+func (fakeClientCodec) DecodeClientResponse(body []byte, reply interface{}) error {
+	return json.Unmarshal(body, reply)
+}
+
+func TestClientCall(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Sum":3}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, fakeClientCodec{})
+	var reply struct{ Sum int }
+	if err := c.Call("Calc.Add", struct{ A, B int }{1, 2}, &reply); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if reply.Sum != 3 {
+		t.Errorf("Sum = %d, want 3", reply.Sum)
+	}
+}
+
+func TestClientCallContextCancellation(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	c := NewClient(srv.URL, fakeClientCodec{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	err := c.CallContext(ctx, "Echo.Do", struct{}{}, &struct{}{})
+	if err == nil {
+		t.Fatal("err = nil, want a context cancellation error")
+	}
+}
+
+func TestClientCloseCancelsInFlightCalls(t *testing.T) {
+	started := make(chan struct{})
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	c := NewClient(srv.URL, fakeClientCodec{})
+	call := c.Go("Echo.Do", struct{}{}, &struct{}{}, nil)
+
+	<-started
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	select {
+	case done := <-call.Done:
+		if done.Error == nil {
+			t.Error("Error = nil, want a cancellation error once Close runs while the call is in flight")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() did not cancel the in-flight call in time")
+	}
+}
+
+func TestClientCallAfterCloseFails(t *testing.T) {
+	c := NewClient("http://127.0.0.1:0", fakeClientCodec{})
+	c.Close()
+
+	err := c.Call("Echo.Do", struct{}{}, &struct{}{})
+	if !errors.Is(err, ErrClientClosed) {
+		t.Errorf("err = %v, want ErrClientClosed", err)
+	}
+}
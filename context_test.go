@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeCodec is a minimal server-side Codec for tests: it reads the method
+// name from an "X-Method" header and marshals args/reply as plain JSON.
+type fakeCodec struct{}
+
+func (fakeCodec) NewRequest(r *http.Request) CodecRequest {
+	return fakeCodecRequest{r: r}
+}
+
+type fakeCodecRequest struct {
+	r *http.Request
+}
+
+func (c fakeCodecRequest) Method() (string, error) {
+	return c.r.Header.Get("X-Method"), nil
+}
+
+func (c fakeCodecRequest) ReadRequest(args interface{}) error {
+	return json.NewDecoder(c.r.Body).Decode(args)
+}
+
+func (c fakeCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
+	return json.NewEncoder(w).Encode(reply)
+}
+
+func (c fakeCodecRequest) WriteErrorResponse(w http.ResponseWriter, err error) {
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func newFakeCodecServer() *Server {
+	s := NewServer(fakeCodec{})
+	s.RegisterCodec(fakeCodec{}, "application/json")
+	return s
+}
+
+type CtxArgs struct{ N int }
+type CtxReply struct{ N int }
+
+// CtxService exercises both call forms RegisterContextService accepts.
+type CtxService struct{}
+
+func (CtxService) CtxOnly(ctx context.Context, args *CtxArgs, reply *CtxReply) error {
+	reply.N = args.N
+	return nil
+}
+
+func (CtxService) CtxReq(ctx context.Context, r *http.Request, args *CtxArgs, reply *CtxReply) error {
+	if r == nil {
+		return errNilRequest
+	}
+	reply.N = args.N + 1
+	return nil
+}
+
+var errNilRequest = &testError{"context-registered method got a nil *http.Request"}
+
+func TestContextServiceDispatch(t *testing.T) {
+	s := newFakeCodecServer()
+	if err := s.RegisterContextService(CtxService{}, ""); err != nil {
+		t.Fatalf("RegisterContextService() error = %v", err)
+	}
+
+	cases := []struct {
+		method string
+		want   int
+	}{
+		{"CtxService.CtxOnly", 5},
+		{"CtxService.CtxReq", 6},
+	}
+	for _, c := range cases {
+		t.Run(c.method, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"N":5}`))
+			req.Header.Set("X-Method", c.method)
+			rec := httptest.NewRecorder()
+
+			s.ServeHTTP(rec, req)
+
+			var reply CtxReply
+			if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+				t.Fatalf("invalid response body %q: %v", rec.Body.String(), err)
+			}
+			if reply.N != c.want {
+				t.Errorf("N = %d, want %d", reply.N, c.want)
+			}
+		})
+	}
+}
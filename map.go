@@ -6,6 +6,7 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -16,9 +17,37 @@ import (
 )
 
 var (
-	// Precompute the reflect.Type of error and http.Request
+	// Precompute the reflect.Type of error, http.Request and context.Context
 	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// callForm records which leading parameters a registered method accepts,
+// beyond its receiver, *args and *reply.
+type callForm int
+
+const (
+	// callArgsOnly methods take (*args, *reply): func(args, reply) error.
+	callArgsOnly callForm = iota
+	// callReq methods take (*http.Request, *args, *reply).
+	callReq
+	// callCtx methods take (context.Context, *args, *reply).
+	callCtx
+	// callCtxReq methods take (context.Context, *http.Request, *args, *reply).
+	callCtxReq
+)
+
+// registerMode controls which callForm(s) a register call will accept.
+// RegisterService only matches callReq, RegisterTCPService only matches
+// callArgsOnly, and RegisterContextService matches callCtx or callCtxReq,
+// recording on each serviceMethod which shape it actually found.
+type registerMode int
+
+const (
+	registerModeReq registerMode = iota
+	registerModeArgsOnly
+	registerModeContext
 )
 
 // ----------------------------------------------------------------------------
@@ -30,13 +59,13 @@ type service struct {
 	rcvr     reflect.Value             // receiver of methods for the service
 	rcvrType reflect.Type              // type of the receiver
 	methods  map[string]*serviceMethod // registered methods
-	passReq  bool
 }
 
 type serviceMethod struct {
 	method    reflect.Method // receiver method
 	argsType  reflect.Type   // type of the request argument
 	replyType reflect.Type   // type of the response argument
+	form      callForm       // which leading parameters the method accepts
 }
 
 // ----------------------------------------------------------------------------
@@ -50,14 +79,13 @@ type serviceMap struct {
 }
 
 // register adds a new service using reflection to extract its methods.
-func (m *serviceMap) register(rcvr interface{}, name string, passReq bool) error {
+func (m *serviceMap) register(rcvr interface{}, name string, mode registerMode) error {
 	// Setup service.
 	s := &service{
 		name:     name,
 		rcvr:     reflect.ValueOf(rcvr),
 		rcvrType: reflect.TypeOf(rcvr),
 		methods:  make(map[string]*serviceMethod),
-		passReq:  passReq,
 	}
 	if name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
@@ -72,56 +100,17 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq bool) error
 	// Setup methods.
 	for i := 0; i < s.rcvrType.NumMethod(); i++ {
 		method := s.rcvrType.Method(i)
-		mtype := method.Type
-
-		// offset the parameter indexes by one if the
-		// service methods accept an HTTP request pointer
-		var paramOffset int
-		if passReq {
-			paramOffset = 1
-		} else {
-			paramOffset = 0
-		}
 
 		// Method must be exported.
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 3+paramOffset {
-			continue
-		}
 
-		// If the service methods accept an HTTP request pointer
-		if passReq {
-			// First argument must be a pointer and must be http.Request.
-			reqType := mtype.In(1)
-			if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
-				continue
-			}
-		}
-		// Next argument must be a pointer and must be exported.
-		args := mtype.In(1 + paramOffset)
-		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
-			continue
-		}
-		// Next argument must be a pointer and must be exported.
-		reply := mtype.In(2 + paramOffset)
-		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
+		sm := matchMethod(method, mode)
+		if sm == nil {
 			continue
 		}
-		// Method needs one out: error.
-		if mtype.NumOut() != 1 {
-			continue
-		}
-		if returnType := mtype.Out(0); returnType != typeOfError {
-			continue
-		}
-		s.methods[method.Name] = &serviceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
-		}
+		s.methods[method.Name] = sm
 	}
 	if len(s.methods) == 0 {
 		return fmt.Errorf("rpc: %q has no exported methods of suitable type",
@@ -139,6 +128,93 @@ func (m *serviceMap) register(rcvr interface{}, name string, passReq bool) error
 	return nil
 }
 
+// matchMethod checks whether method's signature fits one of the call forms
+// allowed by mode, returning the resulting serviceMethod or nil if it
+// doesn't match any of them.
+func matchMethod(method reflect.Method, mode registerMode) *serviceMethod {
+	mtype := method.Type
+
+	var forms []callForm
+	switch mode {
+	case registerModeReq:
+		forms = []callForm{callReq}
+	case registerModeArgsOnly:
+		forms = []callForm{callArgsOnly}
+	case registerModeContext:
+		forms = []callForm{callCtxReq, callCtx}
+	}
+
+	for _, form := range forms {
+		if sm := matchCallForm(mtype, form); sm != nil {
+			sm.method = method
+			return sm
+		}
+	}
+	return nil
+}
+
+// matchCallForm checks mtype (the method's reflect.Type, receiver included)
+// against form's expected leading parameters, *args and *reply.
+func matchCallForm(mtype reflect.Type, form callForm) *serviceMethod {
+	var paramOffset int
+	switch form {
+	case callArgsOnly:
+		paramOffset = 0
+	case callReq, callCtx:
+		paramOffset = 1
+	case callCtxReq:
+		paramOffset = 2
+	}
+
+	// Method needs receiver, leading params, *args, *reply.
+	if mtype.NumIn() != 3+paramOffset {
+		return nil
+	}
+
+	switch form {
+	case callReq:
+		reqType := mtype.In(1)
+		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
+			return nil
+		}
+	case callCtx:
+		if mtype.In(1) != typeOfContext {
+			return nil
+		}
+	case callCtxReq:
+		if mtype.In(1) != typeOfContext {
+			return nil
+		}
+		reqType := mtype.In(2)
+		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
+			return nil
+		}
+	}
+
+	// Next argument must be a pointer and must be exported.
+	args := mtype.In(1 + paramOffset)
+	if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
+		return nil
+	}
+	// Next argument must be a pointer and must be exported.
+	reply := mtype.In(2 + paramOffset)
+	if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
+		return nil
+	}
+	// Method needs one out: error.
+	if mtype.NumOut() != 1 {
+		return nil
+	}
+	if returnType := mtype.Out(0); returnType != typeOfError {
+		return nil
+	}
+	return &serviceMethod{
+		argsType:  args.Elem(),
+		replyType: reply.Elem(),
+		form:      form,
+	}
+}
+
 // get returns a registered service given a method name.
 //
 // The method name uses a dotted notation as in "Service.Method".
@@ -160,6 +236,17 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 	return service, serviceMethod, nil
 }
 
+// splitServiceMethod splits a dotted "Service.Method" name into its two
+// parts. It never fails: input that contains no "." is returned as
+// (method, ""), and input with more than one "." is split at the first.
+func splitServiceMethod(method string) (service, name string) {
+	parts := strings.SplitN(method, ".", 2)
+	if len(parts) != 2 {
+		return method, ""
+	}
+	return parts[0], parts[1]
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// Handler invokes a single decoded RPC call: method is the dotted
+// "Service.Method" name, args and reply are the already-allocated request
+// and response values. ctx carries the incoming request's context; the
+// originating *http.Request, when one is available, can be retrieved with
+// RequestFromContext.
+type Handler func(ctx context.Context, method string, args, reply interface{}) error
+
+// Middleware wraps a Handler with additional behavior, e.g. auth, metrics,
+// tracing or rate-limiting. Middlewares are composed in the order passed to
+// Server.Use: the first one registered is the outermost, so it sees the
+// call first and the response last.
+type Middleware func(next Handler) Handler
+
+type requestContextKey struct{}
+
+// RequestFromContext returns the *http.Request associated with ctx, or nil
+// if ctx wasn't derived from one (e.g. a context built for a TCP call).
+func RequestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestContextKey{}).(*http.Request)
+	return r
+}
+
+func contextWithRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, r)
+}
+
+// Use appends mw to the server's middleware chain and recomposes it. The
+// composed Handler is cached so ServeHTTP only walks the chain once per
+// registration, not once per request.
+func (s *Server) Use(mw ...Middleware) {
+	s.middlewareMu.Lock()
+	defer s.middlewareMu.Unlock()
+	s.middleware = append(s.middleware, mw...)
+	s.rebuildHandlerLocked()
+}
+
+// rebuildHandlerLocked recomposes s.handler from s.invoke and the current
+// middleware chain. Callers must hold s.middlewareMu.
+func (s *Server) rebuildHandlerLocked() {
+	h := Handler(s.invoke)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	s.handler = h
+}
+
+func (s *Server) composedHandler() Handler {
+	s.middlewareMu.RLock()
+	defer s.middlewareMu.RUnlock()
+	return s.handler
+}
+
+// invoke is the innermost Handler: it looks up the registered method and
+// dispatches to it with reflection, in the call form it was registered
+// with (args-only, *http.Request, context.Context, or both).
+func (s *Server) invoke(ctx context.Context, method string, args, reply interface{}) error {
+	serviceSpec, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+
+	callArgs := []reflect.Value{serviceSpec.rcvr}
+	switch methodSpec.form {
+	case callReq:
+		callArgs = append(callArgs, reflect.ValueOf(RequestFromContext(ctx)))
+	case callCtx:
+		callArgs = append(callArgs, reflect.ValueOf(ctx))
+	case callCtxReq:
+		callArgs = append(callArgs, reflect.ValueOf(ctx), reflect.ValueOf(RequestFromContext(ctx)))
+	}
+	callArgs = append(callArgs, reflect.ValueOf(args), reflect.ValueOf(reply))
+
+	errValue := methodSpec.method.Func.Call(callArgs)
+	if errInter := errValue[0].Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
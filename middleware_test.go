@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type EchoArgs struct{ N int }
+type EchoReply struct{ N int }
+
+// EchoService is a plain args-only service used to exercise the
+// middleware chain without pulling in *http.Request or context.Context
+// plumbing.
+type EchoService struct{}
+
+func (EchoService) Echo(args *EchoArgs, reply *EchoReply) error {
+	reply.N = args.N
+	return nil
+}
+
+func newEchoServer(codec Codec) *Server {
+	s := NewServer(codec)
+	s.RegisterCodec(codec, "application/json")
+	if err := s.RegisterTCPService(EchoService{}, ""); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func serveEcho(t *testing.T, s *Server) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"N":1}`))
+	req.Header.Set("X-Method", "EchoService.Echo")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUseComposesMiddlewareInRegistrationOrder(t *testing.T) {
+	s := newEchoServer(fakeCodec{})
+
+	var order []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, method string, args, reply interface{}) error {
+				order = append(order, name+":before")
+				err := next(ctx, method, args, reply)
+				order = append(order, name+":after")
+				return err
+			}
+		}
+	}
+	s.Use(record("outer"), record("inner"))
+
+	serveEcho(t, s)
+
+	want := []string{"outer:before", "inner:before", "inner:after", "outer:after"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Errorf("order[%d] = %q, want %q", i, order[i], want[i])
+		}
+	}
+}
+
+func TestRegisterBeforeFuncRunsBeforeTheHandler(t *testing.T) {
+	s := newEchoServer(fakeCodec{})
+
+	var calledBefore bool
+	s.RegisterBeforeFunc(func(i *RequestInfo) {
+		calledBefore = true
+		if i.Method != "EchoService.Echo" {
+			t.Errorf("Method = %q, want EchoService.Echo", i.Method)
+		}
+	})
+
+	serveEcho(t, s)
+
+	if !calledBefore {
+		t.Error("before func did not run")
+	}
+}
+
+func TestRegisterAfterFuncRunsOnlyAfterWriteResponseSucceeds(t *testing.T) {
+	s := newEchoServer(fakeCodec{})
+
+	var fired bool
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		fired = true
+		if i.StatusCode != http.StatusOK {
+			t.Errorf("StatusCode = %d, want %d", i.StatusCode, http.StatusOK)
+		}
+	})
+
+	serveEcho(t, s)
+
+	if !fired {
+		t.Error("after func did not fire for a successful request")
+	}
+}
+
+// failWriteCodecRequest behaves like fakeCodecRequest but always fails to
+// encode the response, simulating a client that never receives a reply.
+type failWriteCodecRequest struct {
+	fakeCodecRequest
+}
+
+func (failWriteCodecRequest) WriteResponse(http.ResponseWriter, interface{}) error {
+	return errors.New("write failed")
+}
+
+type failWriteCodec struct{}
+
+func (failWriteCodec) NewRequest(r *http.Request) CodecRequest {
+	return failWriteCodecRequest{fakeCodecRequest: fakeCodecRequest{r: r}}
+}
+
+func TestRegisterAfterFuncSkippedWhenWriteResponseFails(t *testing.T) {
+	s := newEchoServer(failWriteCodec{})
+
+	var fired bool
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		fired = true
+	})
+
+	serveEcho(t, s)
+
+	if fired {
+		t.Error("after func fired even though WriteResponse failed and the client never got a response")
+	}
+}
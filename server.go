@@ -6,9 +6,12 @@
 package rpc
 
 import (
+	"context"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -39,14 +42,20 @@ type CodecRequest interface {
 
 // NewServer returns a new RPC server.
 func NewServer(defaultCodec Codec) *Server {
-	return &Server{
+	s := &Server{
 		codecs:       make(map[string]Codec),
 		defaultCodec: defaultCodec,
 		services:     new(serviceMap),
 		supportedMethods: map[string]struct{}{
 			http.MethodPost: {},
 		},
+		tracer:         newTracer(),
+		streamCodec:    NewGobStreamCodec,
+		tcpWorkers:     defaultTCPWorkerPoolSize,
+		tcpReadTimeout: defaultTCPReadTimeout,
 	}
+	s.rebuildHandlerLocked()
+	return s
 }
 
 // RequestInfo contains all the information we pass to before/after functions
@@ -63,9 +72,19 @@ type Server struct {
 	defaultCodec     Codec
 	services         *serviceMap
 	interceptFunc    func(i *RequestInfo) *http.Request
-	beforeFunc       func(i *RequestInfo)
-	afterFunc        func(i *RequestInfo)
 	supportedMethods map[string]struct{}
+	tracer           *tracer
+
+	middlewareMu sync.RWMutex
+	middleware   []Middleware
+	handler      Handler
+
+	afterMu    sync.RWMutex
+	afterFuncs []func(i *RequestInfo)
+
+	streamCodec    NewStreamCodecFunc
+	tcpWorkers     int
+	tcpReadTimeout time.Duration
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -94,11 +113,13 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 //
 // All other methods are ignored.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
-	return s.services.register(receiver, name, true)
+	return s.services.register(receiver, name, registerModeReq)
 }
 
-// RegisterTCPService adds a new TCP service to the server.
-// No HTTP request struct will be passed to the service methods.
+// RegisterTCPService adds a new service to the server whose methods don't
+// accept an *http.Request. It can be called over HTTP like any other
+// service, and its methods are also reachable over a persistent TCP
+// connection served with ServeConn/ListenAndServeTCP.
 //
 // The name parameter is optional: if empty it will be inferred from
 // the receiver type name.
@@ -115,7 +136,22 @@ func (s *Server) RegisterService(receiver interface{}, name string) error {
 //
 // All other methods are ignored.
 func (s *Server) RegisterTCPService(receiver interface{}, name string) error {
-	return s.services.register(receiver, name, false)
+	return s.services.register(receiver, name, registerModeArgsOnly)
+}
+
+// RegisterContextService adds a new service whose methods accept a
+// context.Context, e.g. func (s *S) M(ctx context.Context, args *A, reply *R) error,
+// optionally followed by *http.Request, e.g.
+// func (s *S) M(ctx context.Context, r *http.Request, args *A, reply *R) error.
+//
+// The name parameter is optional: if empty it will be inferred from
+// the receiver type name.
+//
+// The context passed to these methods is derived from the incoming
+// request's r.Context(). All other registration rules from RegisterService
+// apply.
+func (s *Server) RegisterContextService(receiver interface{}, name string) error {
+	return s.services.register(receiver, name, registerModeContext)
 }
 
 // HasMethod returns true if the given method is registered.
@@ -138,22 +174,47 @@ func (s *Server) RegisterInterceptFunc(f func(i *RequestInfo) *http.Request) {
 	s.interceptFunc = f
 }
 
-// RegisterBeforeFunc registers the specified function as the function
-// that will be called before every request.
+// RegisterBeforeFunc registers the specified function to be called before
+// every request, in addition to any previously registered before/after
+// functions or middleware.
 //
-// Note: Only one function can be registered, subsequent calls to this
-// method will overwrite all the previous functions.
+// This is a thin adapter over Use: it appends a Middleware that calls f and
+// then invokes the rest of the chain. For new code, prefer Use directly.
 func (s *Server) RegisterBeforeFunc(f func(i *RequestInfo)) {
-	s.beforeFunc = f
+	s.Use(func(next Handler) Handler {
+		return func(ctx context.Context, method string, args, reply interface{}) error {
+			f(&RequestInfo{
+				Request: RequestFromContext(ctx),
+				Method:  method,
+			})
+			return next(ctx, method, args, reply)
+		}
+	})
 }
 
-// RegisterAfterFunc registers the specified function as the function
-// that will be called after every request
+// RegisterAfterFunc registers the specified function to be called after
+// every request whose service method and response encoding both
+// succeeded, in addition to any previously registered after functions.
 //
-// Note: Only one function can be registered, subsequent calls to this
-// method will overwrite all the previous functions.
+// Unlike RegisterBeforeFunc, this isn't a thin adapter over Use: the
+// response is encoded by codecReq.WriteResponse after the middleware chain
+// returns, so a hook registered via Use would run before the client ever
+// received a response. ServeHTTP calls registered after functions itself,
+// once WriteResponse has succeeded.
 func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
-	s.afterFunc = f
+	s.afterMu.Lock()
+	defer s.afterMu.Unlock()
+	s.afterFuncs = append(s.afterFuncs, f)
+}
+
+// runAfterFuncs calls every function registered with RegisterAfterFunc.
+func (s *Server) runAfterFuncs(info *RequestInfo) {
+	s.afterMu.RLock()
+	fns := s.afterFuncs
+	s.afterMu.RUnlock()
+	for _, f := range fns {
+		f(info)
+	}
 }
 
 func (s *Server) AddSupportedHTTPMethod(method string) {
@@ -168,6 +229,42 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var method string
+	var traceErr error
+
+	// If any subscriber is watching, tee the request/response bodies into
+	// bounded buffers and publish a TraceEvent when the call finishes.
+	if s.tracer.active() {
+		start := time.Now()
+		limit := s.tracer.bodyLimitBytes()
+		reqBody := newBoundedBuffer(limit)
+		respBody := newBoundedBuffer(limit)
+		header := r.Header.Clone()
+		path := r.URL.Path
+		if r.Body != nil {
+			r.Body = &teeReadCloser{rc: r.Body, tee: reqBody}
+		}
+		tw := &traceResponseWriter{ResponseWriter: w, body: respBody}
+		w = tw
+		defer func() {
+			service, m := splitServiceMethod(method)
+			s.tracer.publish(TraceEvent{
+				Service:           service,
+				Method:            m,
+				Path:              path,
+				Header:            header,
+				StartTime:         start,
+				Duration:          time.Since(start),
+				StatusCode:        tw.status,
+				Err:               traceErr,
+				RequestBody:       reqBody.buf,
+				RequestTruncated:  reqBody.truncated,
+				ResponseBody:      respBody.buf,
+				ResponseTruncated: respBody.truncated,
+			})
+		}()
+	}
+
 	contentType := r.Header.Get("Content-Type")
 	idx := strings.Index(contentType, ";")
 	if idx != -1 {
@@ -188,19 +285,23 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Create a new codec request.
 	codecReq := codec.NewRequest(r)
 	// Get service method to be called.
-	method, errMethod := codecReq.Method()
+	var errMethod error
+	method, errMethod = codecReq.Method()
 	if errMethod != nil {
+		traceErr = errMethod
 		s.handleErrorResponse(w, http.StatusOK, codecReq, NewRpcCodecRequestMethodError(errMethod.Error()))
 		return
 	}
-	serviceSpec, methodSpec, errGet := s.services.get(method)
+	_, methodSpec, errGet := s.services.get(method)
 	if errGet != nil {
+		traceErr = errGet
 		s.handleErrorResponse(w, http.StatusOK, codecReq, errGet)
 		return
 	}
 	// Decode the args.
 	args := reflect.New(methodSpec.argsType)
 	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
+		traceErr = errRead
 		s.handleErrorResponse(w, http.StatusOK, codecReq, NewRpcCodecReadRequestError(errRead.Error()))
 		return
 	}
@@ -215,37 +316,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			r = req
 		}
 	}
-	// Call the registered Before Function
-	if s.beforeFunc != nil {
-		s.beforeFunc(&RequestInfo{
-			Request: r,
-			Method:  method,
-		})
-	}
 
-	// Call the service method.
+	// Call the service method through the middleware chain.
 	reply := reflect.New(methodSpec.replyType)
-
-	// omit the HTTP request if the service method doesn't accept it
-	var errValue []reflect.Value
-	if serviceSpec.passReq {
-		errValue = methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
-			reflect.ValueOf(r),
-			args,
-			reply,
-		})
-	} else {
-		errValue = methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
-			args,
-			reply,
-		})
-	}
-
-	errInter := errValue[0].Interface()
-	if errInter != nil {
-		s.handleErrorResponse(w, http.StatusOK, codecReq, errInter.(error))
+	ctx := contextWithRequest(r.Context(), r)
+	if err := s.composedHandler()(ctx, method, args.Interface(), reply.Interface()); err != nil {
+		traceErr = err
+		s.handleErrorResponse(w, http.StatusOK, codecReq, err)
 		return
 	}
 
@@ -254,19 +331,16 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("x-content-type-options", "nosniff")
 	// Encode the response.
 	if errWrite := codecReq.WriteResponse(w, reply.Interface()); errWrite != nil {
+		traceErr = errWrite
 		s.handleErrorResponse(w, http.StatusOK, codecReq, NewRpcCodecWriteResponseError(errWrite.Error()))
 		return
 	}
 
-	// Call the registered After Function
-	if s.afterFunc != nil {
-		s.afterFunc(&RequestInfo{
-			Request:    r,
-			Method:     method,
-			Error:      nil,
-			StatusCode: 200,
-		})
-	}
+	s.runAfterFuncs(&RequestInfo{
+		Request:    r,
+		Method:     method,
+		StatusCode: http.StatusOK,
+	})
 }
 
 func (s *Server) handleErrorResponse(w http.ResponseWriter, status int, codecReq CodecRequest, err error) {
@@ -0,0 +1,292 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// defaultTCPWorkerPoolSize bounds how many calls from a single connection
+// run concurrently; it can be changed with Server.SetTCPWorkerPoolSize.
+const defaultTCPWorkerPoolSize = 32
+
+// defaultTCPReadTimeout bounds how long ServeConn will wait for a client to
+// finish sending a request (header or body) before closing the connection.
+// It can be changed with Server.SetTCPReadTimeout; zero disables the
+// deadline.
+const defaultTCPReadTimeout = 60 * time.Second
+
+// maxFrameSize caps the length a gobStreamCodec will accept for a single
+// frame's 4-byte length prefix. Without a cap, a client can claim a frame
+// of up to 4GiB and force that allocation on every header or body it sends.
+const maxFrameSize = 32 << 20 // 32MiB
+
+// StreamRequestHeader identifies a single call read from a persistent
+// connection. ID is chosen by the client and echoed back in
+// StreamResponseHeader so it can match responses, which may arrive out of
+// order, to the call that produced them.
+type StreamRequestHeader struct {
+	ID     uint64
+	Method string
+}
+
+// StreamResponseHeader is the header written back for a StreamRequestHeader
+// with the same ID. Error is non-empty if and only if the call failed; on
+// failure no reply value is written.
+type StreamResponseHeader struct {
+	ID    uint64
+	Error string
+}
+
+// StreamCodec reads requests from and writes responses to a single
+// persistent connection. It is the TCP counterpart of Codec: where Codec
+// decodes one HTTP request, a StreamCodec is bound to a connection and
+// decodes a sequence of framed requests from it.
+//
+// Implementations handle serialization and framing of their own headers and
+// bodies; ServeConn takes care of concurrency and matching requests to
+// services. The
+// bundled NewGobStreamCodec encodes each header and body as a
+// length-prefixed gob value. A line-delimited JSON codec is just as
+// straightforward to write: ReadRequestHeader/ReadRequestBody read and
+// json.Unmarshal successive '\n'-terminated lines, and WriteResponse
+// json.Marshals the header and reply each followed by '\n'.
+type StreamCodec interface {
+	// ReadRequestHeader reads the next request's header, blocking until one
+	// arrives. It returns an error (typically io.EOF or a net.Error) when
+	// the connection is closed or unusable.
+	ReadRequestHeader(header *StreamRequestHeader) error
+	// ReadRequestBody reads the body following the last header read by
+	// ReadRequestHeader. If args is nil, the body is read and discarded,
+	// e.g. because the requested method doesn't exist.
+	ReadRequestBody(args interface{}) error
+	// WriteResponse writes a response for the call identified by
+	// header.ID. reply is nil when header.Error is non-empty.
+	WriteResponse(header *StreamResponseHeader, reply interface{}) error
+	// Close releases any resources held by the codec.
+	Close() error
+}
+
+// NewStreamCodecFunc creates a StreamCodec bound to a single connection.
+type NewStreamCodecFunc func(rw io.ReadWriteCloser) StreamCodec
+
+// SetStreamCodec overrides the StreamCodec used for TCP connections served
+// with ServeConn/ListenAndServeTCP. The default is NewGobStreamCodec.
+func (s *Server) SetStreamCodec(newCodec NewStreamCodecFunc) {
+	s.streamCodec = newCodec
+}
+
+// SetTCPWorkerPoolSize bounds how many calls from a single TCP connection
+// ServeConn will run concurrently. The default is defaultTCPWorkerPoolSize.
+func (s *Server) SetTCPWorkerPoolSize(n int) {
+	s.tcpWorkers = n
+}
+
+// SetTCPReadTimeout bounds how long ServeConn will wait for a client to
+// finish sending a request's header or body before closing the connection.
+// The default is defaultTCPReadTimeout; d <= 0 disables the deadline.
+func (s *Server) SetTCPReadTimeout(d time.Duration) {
+	s.tcpReadTimeout = d
+}
+
+// ListenAndServeTCP listens on addr and calls ServeConn for each accepted
+// connection in its own goroutine. It blocks until Accept fails, e.g.
+// because the listener was closed.
+func (s *Server) ListenAndServeTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn serves RPC requests framed on a single persistent connection
+// until it is closed or a framing error occurs. Requests are read
+// sequentially but dispatched to a bounded pool of goroutines, so multiple
+// calls from the same connection can be in flight at once; responses carry
+// the request's ID so the client can match them regardless of completion
+// order. ServeConn blocks until every in-flight call on conn has finished
+// and the connection's read loop has ended.
+func (s *Server) ServeConn(conn net.Conn) error {
+	codec := s.streamCodec(conn)
+	defer codec.Close()
+
+	workers := s.tcpWorkers
+	if workers <= 0 {
+		workers = defaultTCPWorkerPoolSize
+	}
+	sem := make(chan struct{}, workers)
+
+	var writeMu sync.Mutex
+	writeResponse := func(header *StreamResponseHeader, reply interface{}) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		codec.WriteResponse(header, reply)
+	}
+
+	var wg sync.WaitGroup
+	for {
+		if s.tcpReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.tcpReadTimeout))
+		}
+
+		var reqHeader StreamRequestHeader
+		if err := codec.ReadRequestHeader(&reqHeader); err != nil {
+			break
+		}
+
+		_, methodSpec, errGet := s.services.get(reqHeader.Method)
+		if errGet != nil {
+			codec.ReadRequestBody(nil)
+			writeResponse(&StreamResponseHeader{ID: reqHeader.ID, Error: errGet.Error()}, nil)
+			continue
+		}
+
+		// Methods registered with a *http.Request parameter (callReq,
+		// callCtxReq) have nothing to bind it to over a raw TCP
+		// connection; reject them cleanly instead of calling them with a
+		// nil *http.Request.
+		if methodSpec.form != callArgsOnly && methodSpec.form != callCtx {
+			codec.ReadRequestBody(nil)
+			writeResponse(&StreamResponseHeader{
+				ID:    reqHeader.ID,
+				Error: fmt.Sprintf("rpc: method %q requires an *http.Request and can't be called over TCP", reqHeader.Method),
+			}, nil)
+			continue
+		}
+
+		args := reflect.New(methodSpec.argsType)
+		if err := codec.ReadRequestBody(args.Interface()); err != nil {
+			writeResponse(&StreamResponseHeader{ID: reqHeader.ID, Error: err.Error()}, nil)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id uint64, method string, args reflect.Value, replyType reflect.Type) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				// A panicking handler must not take the whole server
+				// down with it; report it as a call error instead.
+				if rec := recover(); rec != nil {
+					writeResponse(&StreamResponseHeader{ID: id, Error: fmt.Sprintf("rpc: panic in method %q: %v", method, rec)}, nil)
+				}
+			}()
+
+			reply := reflect.New(replyType)
+			err := s.composedHandler()(context.Background(), method, args.Interface(), reply.Interface())
+			if err != nil {
+				writeResponse(&StreamResponseHeader{ID: id, Error: err.Error()}, nil)
+				return
+			}
+			writeResponse(&StreamResponseHeader{ID: id}, reply.Interface())
+		}(reqHeader.ID, reqHeader.Method, args, methodSpec.replyType)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// gobStreamCodec
+// ----------------------------------------------------------------------------
+
+// gobStreamCodec is the default StreamCodec: each header and body is gob
+// encoded and sent as its own length-prefixed frame.
+type gobStreamCodec struct {
+	rw io.ReadWriteCloser
+}
+
+// NewGobStreamCodec returns a StreamCodec that frames gob-encoded values
+// over rw with a 4-byte big-endian length prefix.
+func NewGobStreamCodec(rw io.ReadWriteCloser) StreamCodec {
+	return &gobStreamCodec{rw: rw}
+}
+
+func (c *gobStreamCodec) ReadRequestHeader(header *StreamRequestHeader) error {
+	frame, err := readFrame(c.rw)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(frame)).Decode(header)
+}
+
+func (c *gobStreamCodec) ReadRequestBody(args interface{}) error {
+	frame, err := readFrame(c.rw)
+	if err != nil {
+		return err
+	}
+	if args == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(frame)).Decode(args)
+}
+
+func (c *gobStreamCodec) WriteResponse(header *StreamResponseHeader, reply interface{}) error {
+	var headerBuf bytes.Buffer
+	if err := gob.NewEncoder(&headerBuf).Encode(header); err != nil {
+		return err
+	}
+	if err := writeFrame(c.rw, headerBuf.Bytes()); err != nil {
+		return err
+	}
+	var replyBuf bytes.Buffer
+	if reply != nil {
+		if err := gob.NewEncoder(&replyBuf).Encode(reply); err != nil {
+			return err
+		}
+	}
+	return writeFrame(c.rw, replyBuf.Bytes())
+}
+
+func (c *gobStreamCodec) Close() error {
+	return c.rw.Close()
+}
+
+// readFrame reads a 4-byte big-endian length prefix followed by that many
+// bytes. The prefix is attacker-controlled, so a length beyond maxFrameSize
+// is rejected instead of allocated.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("rpc: frame size %d exceeds limit of %d bytes", n, maxFrameSize)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeFrame writes payload prefixed with its length as 4 big-endian bytes.
+func writeFrame(w io.Writer, payload []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
@@ -0,0 +1,255 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type AddArgs struct{ A, B int }
+type AddReply struct{ Sum int }
+
+// AddService is a plain args-only service reachable over TCP.
+type AddService struct{}
+
+func (AddService) Add(args *AddArgs, reply *AddReply) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
+
+// PanicService always panics, exercising ServeConn's per-call recover.
+type PanicService struct{}
+
+func (PanicService) Boom(args *struct{}, reply *struct{}) error {
+	panic("kaboom")
+}
+
+// ReqService requires an *http.Request, which has nothing to bind to over
+// a raw TCP connection.
+type ReqService struct{}
+
+func (ReqService) Whoami(r *http.Request, args *struct{}, reply *struct{}) error {
+	_ = r.Header.Get("X-Test")
+	return nil
+}
+
+// ConcurrentService blocks every call on release so tests can observe how
+// many run at once.
+type ConcurrentService struct {
+	mu      sync.Mutex
+	running int
+	maxSeen int
+	release chan struct{}
+}
+
+func (s *ConcurrentService) Block(args *struct{}, reply *struct{}) error {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.maxSeen {
+		s.maxSeen = s.running
+	}
+	s.mu.Unlock()
+
+	<-s.release
+
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	return nil
+}
+
+// writeStreamRequest writes a request frame pair the way a TCP client
+// would, using the same gob framing ServeConn expects.
+func writeStreamRequest(w io.Writer, header StreamRequestHeader, body interface{}) error {
+	var hbuf bytes.Buffer
+	if err := gob.NewEncoder(&hbuf).Encode(header); err != nil {
+		return err
+	}
+	if err := writeFrame(w, hbuf.Bytes()); err != nil {
+		return err
+	}
+	var bbuf bytes.Buffer
+	if err := gob.NewEncoder(&bbuf).Encode(body); err != nil {
+		return err
+	}
+	return writeFrame(w, bbuf.Bytes())
+}
+
+func readStreamResponseHeader(r io.Reader) (StreamResponseHeader, error) {
+	var header StreamResponseHeader
+	frame, err := readFrame(r)
+	if err != nil {
+		return header, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(frame)).Decode(&header)
+	return header, err
+}
+
+func readStreamResponseBody(r io.Reader, reply interface{}) error {
+	frame, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if len(frame) == 0 || reply == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(frame)).Decode(reply)
+}
+
+func TestServeConnRoundTrip(t *testing.T) {
+	s := NewServer(nil)
+	if err := s.RegisterTCPService(AddService{}, ""); err != nil {
+		t.Fatalf("RegisterTCPService() error = %v", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(serverConn)
+		close(done)
+	}()
+
+	if err := writeStreamRequest(clientConn, StreamRequestHeader{ID: 1, Method: "AddService.Add"}, AddArgs{A: 2, B: 3}); err != nil {
+		t.Fatalf("writeStreamRequest() error = %v", err)
+	}
+
+	header, err := readStreamResponseHeader(clientConn)
+	if err != nil {
+		t.Fatalf("read response header: %v", err)
+	}
+	if header.Error != "" {
+		t.Fatalf("response error = %q", header.Error)
+	}
+	var reply AddReply
+	if err := readStreamResponseBody(clientConn, &reply); err != nil {
+		t.Fatalf("read response body: %v", err)
+	}
+	if reply.Sum != 5 {
+		t.Errorf("Sum = %d, want 5", reply.Sum)
+	}
+
+	clientConn.Close()
+	<-done
+}
+
+func TestServeConnRecoversPanics(t *testing.T) {
+	s := NewServer(nil)
+	if err := s.RegisterTCPService(PanicService{}, ""); err != nil {
+		t.Fatalf("RegisterTCPService() error = %v", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(serverConn)
+		close(done)
+	}()
+
+	if err := writeStreamRequest(clientConn, StreamRequestHeader{ID: 1, Method: "PanicService.Boom"}, struct{}{}); err != nil {
+		t.Fatalf("writeStreamRequest() error = %v", err)
+	}
+
+	header, err := readStreamResponseHeader(clientConn)
+	if err != nil {
+		t.Fatalf("read response header: %v", err)
+	}
+	if header.Error == "" {
+		t.Error("Error = \"\", want a panic error instead of the connection (and process) crashing")
+	}
+
+	clientConn.Close()
+	<-done
+}
+
+func TestServeConnRejectsHTTPBoundMethods(t *testing.T) {
+	s := NewServer(nil)
+	if err := s.RegisterService(ReqService{}, ""); err != nil {
+		t.Fatalf("RegisterService() error = %v", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(serverConn)
+		close(done)
+	}()
+
+	if err := writeStreamRequest(clientConn, StreamRequestHeader{ID: 1, Method: "ReqService.Whoami"}, struct{}{}); err != nil {
+		t.Fatalf("writeStreamRequest() error = %v", err)
+	}
+
+	header, err := readStreamResponseHeader(clientConn)
+	if err != nil {
+		t.Fatalf("read response header: %v", err)
+	}
+	if header.Error == "" {
+		t.Error("Error = \"\", want a rejection instead of calling the method with a nil *http.Request")
+	}
+
+	clientConn.Close()
+	<-done
+}
+
+func TestServeConnWorkerPoolBoundsConcurrency(t *testing.T) {
+	const workers = 3
+	svc := &ConcurrentService{release: make(chan struct{})}
+	s := NewServer(nil)
+	s.SetTCPWorkerPoolSize(workers)
+	if err := s.RegisterTCPService(svc, "Concurrent"); err != nil {
+		t.Fatalf("RegisterTCPService() error = %v", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(serverConn)
+		close(done)
+	}()
+
+	// Send one more call than the pool allows; it must wait for a slot.
+	for i := 0; i < workers+1; i++ {
+		if err := writeStreamRequest(clientConn, StreamRequestHeader{ID: uint64(i + 1), Method: "Concurrent.Block"}, struct{}{}); err != nil {
+			t.Fatalf("writeStreamRequest() error = %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		svc.mu.Lock()
+		seen := svc.maxSeen
+		svc.mu.Unlock()
+		if seen == workers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("maxSeen = %d, want %d calls running concurrently", seen, workers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	svc.mu.Lock()
+	seen := svc.maxSeen
+	svc.mu.Unlock()
+	if seen != workers {
+		t.Fatalf("maxSeen = %d, want at most %d calls running concurrently", seen, workers)
+	}
+
+	close(svc.release)
+	for i := 0; i < workers+1; i++ {
+		if _, err := readStreamResponseHeader(clientConn); err != nil {
+			t.Fatalf("read response %d header: %v", i, err)
+		}
+		if err := readStreamResponseBody(clientConn, nil); err != nil {
+			t.Fatalf("read response %d body: %v", i, err)
+		}
+	}
+
+	clientConn.Close()
+	<-done
+}
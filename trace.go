@@ -0,0 +1,305 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default limits for the trace subsystem. defaultTraceBodyLimit can be
+// overridden per-server with Server.SetTraceBodyLimit; the others are fixed.
+const (
+	defaultTraceBodyLimit  = 64 * 1024
+	defaultTraceBufferSize = 64
+	// defaultTraceRingSize is how many past events the tracer keeps so a
+	// subscriber that connects after the fact can be backfilled with
+	// recent history instead of only seeing events from here on.
+	defaultTraceRingSize = 256
+)
+
+// TraceEvent describes a single RPC call as observed by a trace subscriber.
+//
+// RequestBody and ResponseBody are captured up to the server's configured
+// body limit; {Request,Response}Truncated report whether the captured body
+// was cut short.
+type TraceEvent struct {
+	Service    string
+	Method     string
+	Path       string
+	Header     http.Header
+	StartTime  time.Time
+	Duration   time.Duration
+	StatusCode int
+	Err        error
+
+	RequestBody       []byte
+	RequestTruncated  bool
+	ResponseBody      []byte
+	ResponseTruncated bool
+}
+
+// TraceFilter narrows the set of TraceEvents delivered to a subscriber.
+//
+// A zero-value TraceFilter matches every event. Fields are ANDed together.
+type TraceFilter struct {
+	// MethodGlob matches against "Service.Method" using path.Match syntax,
+	// e.g. "Accounts.*" or "*.Delete*". Empty matches everything.
+	MethodGlob string
+	// PathPrefix matches the HTTP request path, e.g. "/admin/". Empty
+	// matches everything.
+	PathPrefix string
+	// ErrorsOnly, when true, only delivers events that ended in an error.
+	ErrorsOnly bool
+	// MinStatusCode, when non-zero, only delivers events whose StatusCode
+	// is greater than or equal to it.
+	MinStatusCode int
+}
+
+func (f TraceFilter) matches(ev *TraceEvent) bool {
+	if f.ErrorsOnly && ev.Err == nil {
+		return false
+	}
+	if f.MinStatusCode != 0 && ev.StatusCode < f.MinStatusCode {
+		return false
+	}
+	if f.PathPrefix != "" && !strings.HasPrefix(ev.Path, f.PathPrefix) {
+		return false
+	}
+	if f.MethodGlob != "" {
+		ok, err := path.Match(f.MethodGlob, ev.Service+"."+ev.Method)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// traceSubscriber fans trace events out to a single caller of Subscribe.
+type traceSubscriber struct {
+	ch      chan TraceEvent
+	filter  TraceFilter
+	dropped uint64 // atomic
+}
+
+// tracer owns the subscriber registry and fans out published events. A
+// tracer with no subscribers is effectively free: Server.ServeHTTP checks
+// tracer.active() before paying for body capture.
+type tracer struct {
+	// bodyLimit is accessed atomically and must stay the first field so it
+	// stays 64-bit aligned on 32-bit platforms.
+	bodyLimit int64 // atomic; read/written via bodyLimitBytes()/setBodyLimit()
+
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[uint64]*traceSubscriber
+	ring   []TraceEvent // most recent defaultTraceRingSize events, oldest first
+}
+
+func newTracer() *tracer {
+	t := &tracer{
+		subs: make(map[uint64]*traceSubscriber),
+	}
+	t.setBodyLimit(defaultTraceBodyLimit)
+	return t
+}
+
+// bodyLimitBytes returns the current per-event body capture limit.
+func (t *tracer) bodyLimitBytes() int {
+	return int(atomic.LoadInt64(&t.bodyLimit))
+}
+
+// setBodyLimit sets the per-event body capture limit. Safe to call
+// concurrently with in-flight requests: it takes effect for the next call
+// observed by ServeHTTP.
+func (t *tracer) setBodyLimit(n int) {
+	atomic.StoreInt64(&t.bodyLimit, int64(n))
+}
+
+func (t *tracer) active() bool {
+	t.mu.Lock()
+	n := len(t.subs)
+	t.mu.Unlock()
+	return n > 0
+}
+
+// subscribe registers a new subscriber and backfills it with buffered
+// history matching filter before returning, so a subscriber that connects
+// after interesting events happened still sees them.
+func (t *tracer) subscribe(filter TraceFilter) (uint64, *traceSubscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	id := t.nextID
+	sub := &traceSubscriber{
+		ch:     make(chan TraceEvent, defaultTraceBufferSize),
+		filter: filter,
+	}
+	for _, ev := range t.ring {
+		if !filter.matches(&ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+	t.subs[id] = sub
+	return id, sub
+}
+
+func (t *tracer) unsubscribe(id uint64) {
+	t.mu.Lock()
+	sub, ok := t.subs[id]
+	delete(t.subs, id)
+	t.mu.Unlock()
+	if ok {
+		close(sub.ch)
+	}
+}
+
+// publish fans ev out to every subscriber whose filter matches. Sends are
+// non-blocking: a subscriber that isn't keeping up has the event dropped and
+// its dropped counter incremented instead of stalling the call.
+func (t *tracer) publish(ev TraceEvent) {
+	t.mu.Lock()
+	t.ring = append(t.ring, ev)
+	if len(t.ring) > defaultTraceRingSize {
+		t.ring = t.ring[len(t.ring)-defaultTraceRingSize:]
+	}
+	subs := make([]*traceSubscriber, 0, len(t.subs))
+	for _, sub := range t.subs {
+		subs = append(subs, sub)
+	}
+	t.mu.Unlock()
+
+	for _, sub := range subs {
+		if !sub.filter.matches(&ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Subscription is returned by Server.Subscribe. Events delivers TraceEvents
+// matching the subscription's filter, backfilled with any buffered history
+// that already matched it; it is closed when the ctx passed to Subscribe is
+// done.
+type Subscription struct {
+	Events <-chan TraceEvent
+
+	sub *traceSubscriber
+}
+
+// Dropped returns how many events matching this subscription's filter were
+// discarded because Events wasn't being drained fast enough. A consumer
+// that cares about completeness (e.g. an audit log) should check this
+// periodically rather than assume Events is a complete record.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.sub.dropped)
+}
+
+// Subscribe registers the caller to receive TraceEvents for calls matching
+// filter. The subscription, and the goroutine that watches ctx, stay alive
+// until ctx is done, so a ctx that is never done keeps them for the life of
+// the server. Callers should check Subscription.Dropped if they need to know
+// whether they missed any events.
+func (s *Server) Subscribe(ctx context.Context, filter TraceFilter) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	id, sub := s.tracer.subscribe(filter)
+	go func() {
+		<-ctx.Done()
+		s.tracer.unsubscribe(id)
+	}()
+	return &Subscription{Events: sub.ch, sub: sub}, nil
+}
+
+// SetTraceBodyLimit sets the maximum number of request/response body bytes
+// captured per TraceEvent. It is safe to call at any time, including
+// concurrently with in-flight requests; calls already being traced keep the
+// limit that was in effect when they started.
+func (s *Server) SetTraceBodyLimit(n int) {
+	s.tracer.setBodyLimit(n)
+}
+
+// boundedBuffer is an io.Writer that keeps at most limit bytes, recording
+// whether writes beyond that point were discarded.
+type boundedBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func newBoundedBuffer(limit int) *boundedBuffer {
+	return &boundedBuffer{limit: limit}
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.buf); room > 0 {
+		if len(p) > room {
+			b.buf = append(b.buf, p[:room]...)
+			b.truncated = true
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// teeReadCloser tees reads of an http.Request body into a boundedBuffer
+// while preserving the original io.ReadCloser's Close behavior.
+type teeReadCloser struct {
+	rc  interface {
+		Read([]byte) (int, error)
+		Close() error
+	}
+	tee *boundedBuffer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		t.tee.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	return t.rc.Close()
+}
+
+// traceResponseWriter wraps an http.ResponseWriter, capturing the status
+// code and a bounded copy of the response body as it is written.
+type traceResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	body        *boundedBuffer
+	wroteHeader bool
+}
+
+func (w *traceResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+		w.wroteHeader = true
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
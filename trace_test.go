@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceFilterMatches(t *testing.T) {
+	base := TraceEvent{Service: "Accounts", Method: "Delete", Path: "/rpc", StatusCode: 200}
+	errEvent := base
+	errEvent.Err = errTraceTest
+	errEvent.StatusCode = 500
+
+	type testCase struct {
+		name   string
+		filter TraceFilter
+		ev     TraceEvent
+		want   bool
+	}
+	cases := []testCase{
+		{"zero value matches everything", TraceFilter{}, base, true},
+		{"method glob matches", TraceFilter{MethodGlob: "Accounts.*"}, base, true},
+		{"method glob rejects", TraceFilter{MethodGlob: "Widgets.*"}, base, false},
+		{"path prefix matches", TraceFilter{PathPrefix: "/rpc"}, base, true},
+		{"path prefix rejects", TraceFilter{PathPrefix: "/admin"}, base, false},
+		{"errors only rejects success", TraceFilter{ErrorsOnly: true}, base, false},
+		{"errors only accepts error", TraceFilter{ErrorsOnly: true}, errEvent, true},
+		{"min status rejects 200", TraceFilter{MinStatusCode: 400}, base, false},
+		{"min status accepts 500", TraceFilter{MinStatusCode: 400}, errEvent, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.filter.matches(&c.ev); got != c.want {
+				t.Errorf("matches() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+var errTraceTest = &testError{"boom"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }
+
+func TestBoundedBufferTruncates(t *testing.T) {
+	b := newBoundedBuffer(4)
+	b.Write([]byte("ab"))
+	b.Write([]byte("cdef"))
+
+	if got, want := string(b.buf), "abcd"; got != want {
+		t.Errorf("buf = %q, want %q", got, want)
+	}
+	if !b.truncated {
+		t.Error("truncated = false, want true")
+	}
+}
+
+func TestBoundedBufferNoTruncation(t *testing.T) {
+	b := newBoundedBuffer(16)
+	b.Write([]byte("hello"))
+
+	if got, want := string(b.buf), "hello"; got != want {
+		t.Errorf("buf = %q, want %q", got, want)
+	}
+	if b.truncated {
+		t.Error("truncated = true, want false")
+	}
+}
+
+func TestTracerConcurrentSubscribers(t *testing.T) {
+	tr := newTracer()
+
+	const numSubscribers = 8
+	ids := make([]uint64, numSubscribers)
+	subs := make([]*traceSubscriber, numSubscribers)
+	for i := 0; i < numSubscribers; i++ {
+		id, sub := tr.subscribe(TraceFilter{})
+		ids[i] = id
+		subs[i] = sub
+	}
+	defer func() {
+		for _, id := range ids {
+			tr.unsubscribe(id)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numSubscribers; i++ {
+		wg.Add(1)
+		go func(sub *traceSubscriber) {
+			defer wg.Done()
+			select {
+			case ev := <-sub.ch:
+				if ev.Method != "Get" {
+					t.Errorf("got method %q, want Get", ev.Method)
+				}
+			case <-time.After(time.Second):
+				t.Error("timed out waiting for trace event")
+			}
+		}(subs[i])
+	}
+
+	tr.publish(TraceEvent{Service: "Items", Method: "Get"})
+	wg.Wait()
+}
+
+func TestTracerDropsWhenSubscriberIsSlow(t *testing.T) {
+	tr := newTracer()
+	_, sub := tr.subscribe(TraceFilter{})
+
+	// Fill the subscriber's buffered channel without draining it so the
+	// next publish has nowhere to go.
+	for i := 0; i < defaultTraceBufferSize+5; i++ {
+		tr.publish(TraceEvent{Method: "Get"})
+	}
+
+	if dropped := sub.dropped; dropped == 0 {
+		t.Error("dropped = 0, want > 0 once the subscriber's channel fills up")
+	}
+}
+
+func TestTracerRingBufferBackfillsNewSubscribers(t *testing.T) {
+	tr := newTracer()
+	// No subscriber exists yet, but simulate events published while at
+	// least one other subscriber was active.
+	_, warm := tr.subscribe(TraceFilter{})
+	defer close(warm.ch)
+
+	tr.publish(TraceEvent{Service: "Items", Method: "Get", StatusCode: 200})
+	tr.publish(TraceEvent{Service: "Items", Method: "Delete", StatusCode: 500, Err: errTraceTest})
+
+	_, late := tr.subscribe(TraceFilter{MethodGlob: "Items.Delete"})
+	select {
+	case ev := <-late.ch:
+		if ev.Method != "Delete" {
+			t.Errorf("backfilled method = %q, want Delete", ev.Method)
+		}
+	default:
+		t.Error("expected a backfilled event matching the filter, got none")
+	}
+}
+
+func TestServerSubscribeDropped(t *testing.T) {
+	s := NewServer(nil)
+	sub, err := s.Subscribe(context.Background(), TraceFilter{})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if got := sub.Dropped(); got != 0 {
+		t.Errorf("Dropped() = %d, want 0 for a fresh subscription", got)
+	}
+}